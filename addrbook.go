@@ -0,0 +1,237 @@
+package ezmesh
+
+/*
+ * addrbook.go
+ * Persists known peer addresses to disk
+ * By J. Stuart McMurray
+ * Created 20170420
+ * Last Modified 20170512
+ */
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// addrBookDiscoveryInterval is how often a Peer reconciles its AddrBook
+// against mesh's current view of established connections.
+const addrBookDiscoveryInterval = 5 * time.Second
+
+// AddrBookEntry describes a single peer known to an AddrBook.
+type AddrBookEntry struct {
+	Addr     string
+	PeerName PeerName
+	NickName string
+	LastSeen time.Time
+}
+
+// AddrBook persists the addresses of peers seen on the mesh network to a
+// JSON file on disk, so they may be reused (e.g. as InitialPeers) across
+// restarts.  An AddrBook is safe for concurrent use.
+type AddrBook struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]*AddrBookEntry
+}
+
+// loadAddrBook reads the AddrBook stored at path, if it exists.  If path is
+// the empty string, an empty AddrBook which is never saved is returned.  If
+// no file exists at path, an empty AddrBook is returned which is saved to
+// path on its first change.
+func loadAddrBook(path string) (*AddrBook, error) {
+	ab := &AddrBook{
+		path:    path,
+		entries: make(map[string]*AddrBookEntry),
+	}
+	if "" == path {
+		return ab, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if nil != err {
+		if os.IsNotExist(err) {
+			return ab, nil
+		}
+		return nil, err
+	}
+	if 0 == len(b) {
+		return ab, nil
+	}
+	var es []*AddrBookEntry
+	if err := json.Unmarshal(b, &es); nil != err {
+		return nil, err
+	}
+	for _, e := range es {
+		ab.entries[e.Addr] = e
+	}
+	return ab, nil
+}
+
+// Update records addr, name, and nick as having been seen just now, and
+// saves the AddrBook to disk.
+func (ab *AddrBook) Update(addr *net.TCPAddr, name PeerName, nick string) error {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	ab.entries[addr.String()] = &AddrBookEntry{
+		Addr:     addr.String(),
+		PeerName: name,
+		NickName: nick,
+		LastSeen: time.Now(),
+	}
+	return ab.save()
+}
+
+// Remove forgets addr, and saves the AddrBook to disk.
+func (ab *AddrBook) Remove(addr *net.TCPAddr) error {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	delete(ab.entries, addr.String())
+	return ab.save()
+}
+
+// Entries returns a copy of every entry known to the AddrBook.
+func (ab *AddrBook) Entries() []AddrBookEntry {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	es := make([]AddrBookEntry, 0, len(ab.entries))
+	for _, e := range ab.entries {
+		es = append(es, *e)
+	}
+	return es
+}
+
+// Addrs returns every address known to the AddrBook.
+func (ab *AddrBook) Addrs() []*net.TCPAddr {
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+	addrs := make([]*net.TCPAddr, 0, len(ab.entries))
+	for _, e := range ab.entries {
+		a, err := net.ResolveTCPAddr("tcp", e.Addr)
+		if nil != err {
+			continue
+		}
+		addrs = append(addrs, a)
+	}
+	return addrs
+}
+
+// save writes the AddrBook to ab.path, if it is set.  It must be called with
+// ab.mu held.  The write is atomic; it writes to a temporary file in the
+// same directory as ab.path, then renames it into place.
+func (ab *AddrBook) save() error {
+	if "" == ab.path {
+		return nil
+	}
+	es := make([]*AddrBookEntry, 0, len(ab.entries))
+	for _, e := range ab.entries {
+		es = append(es, e)
+	}
+	b, err := json.Marshal(es)
+	if nil != err {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(ab.path), ".addrbook")
+	if nil != err {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); nil != err {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); nil != err {
+		return err
+	}
+	return os.Rename(tmp.Name(), ab.path)
+}
+
+// addrBookDiscoveryLoop keeps p's AddrBook in sync with peers mesh actually
+// discovers and loses, until p is closed.
+func (p *Peer) addrBookDiscoveryLoop() {
+	t := time.NewTicker(addrBookDiscoveryInterval)
+	defer t.Stop()
+	for {
+		p.reconcileAddrBook()
+		select {
+		case <-p.stopCh:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// reconcileAddrBook walks mesh's current view of established connections
+// (via mesh.NewStatus, the same introspection the mesh package's own status
+// page uses), recording the real PeerName and NickName for every reachable
+// address so the zero-value placeholders left by AddPersistentPeer and
+// pex.merge get filled in once the connection actually completes its
+// handshake, and forgetting addresses which have gone from established to
+// not and aren't currently marked persistent.
+func (p *Peer) reconcileAddrBook() {
+	ourName := p.Router.Ourself.Name.String()
+
+	established := make(map[string]bool)
+	for _, pd := range mesh.NewStatus(p.Router).Peers {
+		/* Only our own connections tell us about addresses we can
+		reach; a far peer's connections to other far peers aren't
+		necessarily addresses we could dial ourselves. */
+		if pd.Name != ourName {
+			continue
+		}
+		for _, cd := range pd.Connections {
+			if !cd.Established {
+				continue
+			}
+			addr, err := net.ResolveTCPAddr("tcp", cd.Address)
+			if nil != err {
+				continue
+			}
+			name, err := UnStringPeerName(cd.Name)
+			if nil != err {
+				continue
+			}
+			established[addr.String()] = true
+			p.addrBook.Update(addr, name, cd.NickName)
+		}
+	}
+
+	p.discoveryMu.Lock()
+	wasEstablished := p.establishedAddr
+	p.establishedAddr = established
+	p.discoveryMu.Unlock()
+
+	for key := range wasEstablished {
+		if established[key] {
+			continue
+		}
+		p.persistentMu.Lock()
+		_, persistent := p.persistent[key]
+		p.persistentMu.Unlock()
+		if persistent {
+			continue
+		}
+		addr, err := net.ResolveTCPAddr("tcp", key)
+		if nil != err {
+			continue
+		}
+		p.addrBook.Remove(addr)
+	}
+}
+
+// connectedPeerCount returns the number of peers p currently has an
+// established direct connection to, as of the last addrBookDiscoveryLoop
+// reconciliation.  Unlike len(p.Router.Peers.Descriptions()), which counts
+// every peer known anywhere in the mesh (including ones reachable only
+// transitively through other peers), this reflects only p's own direct
+// connections, making it suitable for enforcing Config.ConnLimit.
+func (p *Peer) connectedPeerCount() int {
+	p.discoveryMu.Lock()
+	defer p.discoveryMu.Unlock()
+	return len(p.establishedAddr)
+}
@@ -0,0 +1,194 @@
+package ezmesh
+
+/*
+ * channel.go
+ * Multiple named gossip channels
+ * By J. Stuart McMurray
+ * Created 20170426
+ * Last Modified 20170512
+ */
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// defaultChannelName is the name of the channel backing the top-level
+// Peer.Send and Peer.Broadcast methods.
+const defaultChannelName = "defaultchannel"
+
+// ChannelHandlers holds the callbacks invoked when a message is received on
+// a Channel.  Either may be nil, in which case messages of that kind are
+// silently ignored.
+type ChannelHandlers struct {
+	// OnMessage is called when a unicast (peer-to-peer) message is
+	// received on the channel.
+	OnMessage func(c *Channel, src PeerName, message []byte) error
+
+	// OnBroadcast is called when a broadcast (peer-to-everybody) message
+	// is received on the channel.
+	OnBroadcast func(c *Channel, src PeerName, message []byte) error
+}
+
+// Channel is an independent gossip channel, with its own message handlers,
+// obtained with Peer's Subscribe method.  This lets different subsystems
+// (e.g. a shell-command channel, the PEX channel, a telemetry channel)
+// gossip without colliding with one another.
+type Channel struct {
+	// Name is the name with which the channel was Subscribed.
+	Name string
+
+	// TX and RX provide access to the underlying mesh structures backing
+	// the channel.
+	TX mesh.Gossip
+	RX mesh.Gossiper
+
+	p *Peer
+
+	mu       sync.Mutex
+	handlers ChannelHandlers
+	active   bool
+}
+
+// Send sends message to dst on c.
+func (c *Channel) Send(dst PeerName, message []byte) error {
+	return c.TX.GossipUnicast(mesh.PeerName(dst), message)
+}
+
+// Broadcast sends message to every peer in the mesh network on c.
+func (c *Channel) Broadcast(message []byte) {
+	c.TX.GossipBroadcast(gd(message))
+}
+
+// Subscribe creates a new gossip channel named channel, with messages
+// dispatched to handlers.  It is an error to Subscribe to a channel name
+// which already has an active Subscribe.  Re-subscribing to a channel name
+// that was previously Unsubscribed reuses the existing mesh gossip channel
+// rather than creating a new one, since the underlying
+// github.com/weaveworks/mesh Router fatally crashes the process on a
+// duplicate channel name.
+func (p *Peer) Subscribe(
+	channel string,
+	handlers ChannelHandlers,
+) (*Channel, error) {
+	p.channelsMu.Lock()
+	defer p.channelsMu.Unlock()
+
+	if c, ok := p.channels[channel]; ok {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.active {
+			return nil, fmt.Errorf(
+				"already subscribed to channel %q",
+				channel,
+			)
+		}
+		c.handlers = handlers
+		c.active = true
+		return c, nil
+	}
+
+	c := &Channel{
+		Name:     channel,
+		p:        p,
+		handlers: handlers,
+		active:   true,
+	}
+	cr := &channelReceiver{c: c}
+	c.RX = cr
+	c.TX = p.Router.NewGossip(channel, cr)
+
+	p.channels[channel] = c
+
+	return c, nil
+}
+
+// Unsubscribe removes the handlers installed for channel, so no more
+// messages will be dispatched.  The underlying mesh gossip channel, which
+// cannot be torn down, is left running (and kept alive, handler-less, in
+// p.channels) so a later Subscribe to the same name can resume using it
+// instead of crashing on a duplicate channel name.
+//
+// The default channel, which backs Peer's Send and Broadcast, is an
+// exception: its messages always go to Peer's OnMessage and OnBroadcast, so
+// Unsubscribing it only drops it from Channels, and handlers given to a
+// later Subscribe to it are never called.
+func (p *Peer) Unsubscribe(channel string) error {
+	p.channelsMu.Lock()
+	defer p.channelsMu.Unlock()
+
+	c, ok := p.channels[channel]
+	if !ok {
+		return fmt.Errorf("not subscribed to channel %q", channel)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.active {
+		return fmt.Errorf("not subscribed to channel %q", channel)
+	}
+	c.handlers = ChannelHandlers{}
+	c.active = false
+
+	return nil
+}
+
+// Channels returns the names of every channel currently Subscribed.
+func (p *Peer) Channels() []string {
+	p.channelsMu.Lock()
+	defer p.channelsMu.Unlock()
+
+	names := make([]string, 0, len(p.channels))
+	for name, c := range p.channels {
+		c.mu.Lock()
+		active := c.active
+		c.mu.Unlock()
+		if active {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+/* channelReceiver adapts a Channel's ChannelHandlers to mesh.Gossiper,
+in the same fashion as receiver does for Peer's top-level OnMessage and
+OnBroadcast. */
+type channelReceiver struct {
+	c *Channel
+}
+
+func (r *channelReceiver) OnGossipUnicast(src mesh.PeerName, msg []byte) error {
+	if rl := r.c.p.rateLimiter; nil != rl && !rl.allow(src) {
+		return nil
+	}
+	r.c.mu.Lock()
+	h := r.c.handlers.OnMessage
+	r.c.mu.Unlock()
+	if nil == h {
+		return nil
+	}
+	return h(r.c, PeerName(src), msg)
+}
+
+func (r *channelReceiver) OnGossipBroadcast(
+	src mesh.PeerName,
+	msg []byte,
+) (mesh.GossipData, error) {
+	if rl := r.c.p.rateLimiter; nil != rl && !rl.allow(src) {
+		return gd(msg), nil
+	}
+	r.c.mu.Lock()
+	h := r.c.handlers.OnBroadcast
+	r.c.mu.Unlock()
+	if nil == h {
+		return gd(msg), nil
+	}
+	return gd(msg), h(r.c, PeerName(src), msg)
+}
+
+/* Since channels don't keep accumulated state, these aren't useful. */
+func (r *channelReceiver) Gossip() (complete mesh.GossipData) { return nil }
+func (r *channelReceiver) OnGossip(msg []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
@@ -7,13 +7,16 @@ package ezmesh
  * Wraps github.com/weaveworks/mesh for ease of use
  * By J. Stuart McMurray
  * Created 20170410
- * Last Modified 20170413
+ * Last Modified 20170512
  */
 
 import (
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
+	"github.com/magisterquis/ezmesh/nat"
 	"github.com/weaveworks/mesh"
 )
 
@@ -37,6 +40,30 @@ type Peer struct {
 	TX     mesh.Gossip
 	RX     mesh.Gossiper
 	Router *mesh.Router
+
+	config Config
+
+	addrBook *AddrBook
+
+	persistentMu sync.Mutex
+	persistent   map[string]*persistentPeer
+
+	discoveryMu     sync.Mutex
+	establishedAddr map[string]bool
+
+	pex *pex
+
+	channelsMu sync.Mutex
+	channels   map[string]*Channel
+
+	rateLimiter *rateLimiter
+
+	natMu      sync.Mutex
+	natMapping *nat.Mapping
+	natRelease func() error
+
+	closeOnce sync.Once
+	stopCh    chan struct{}
 }
 
 // Config contains parameters needed to connect to the mesh network.
@@ -69,8 +96,55 @@ type Config struct {
 	// InitialPeers is a slice of addresses containing other peers to which
 	// to connect.  This slice may be empty.  More peers may be added with
 	// Peer's Connect method.
+	//
+	// Every address in InitialPeers is treated as a persistent peer; if
+	// the connection to it is lost it will automatically be redialed
+	// with an exponential backoff.  See AddPersistentPeer for details.
 	InitialPeers []*net.TCPAddr
 
+	// MaxReconnectInterval caps the exponential backoff used when
+	// reconnecting to a persistent peer.  If zero, a default of one
+	// minute is used.
+	MaxReconnectInterval time.Duration
+
+	// MaxReconnectAttempts caps the number of reconnection attempts made
+	// to a persistent peer before giving up on it: ezmesh stops redialing
+	// and tells the underlying mesh.Router to forget the target, so
+	// mesh's own connection maker (which otherwise retries direct
+	// targets indefinitely on its own schedule) stops too.  If zero,
+	// attempts are unlimited.
+	MaxReconnectAttempts int
+
+	// AddrBookPath, if not empty, names a file in which to persist the
+	// addresses of peers seen on the mesh network (as well as the
+	// addresses in InitialPeers).  The file is read by New and rewritten
+	// atomically as peers are discovered or lost.
+	AddrBookPath string
+
+	// PEXInterval, if positive, enables the peer-exchange (PEX)
+	// subsystem: every PEXInterval, the local peer's known addresses are
+	// gossiped to the rest of the mesh, and addresses learned this way
+	// (or via RequestPeers) are recorded in the AddrBook and, if
+	// AutoConnect is set, dialed.
+	PEXInterval time.Duration
+
+	// PEXResponseWindow limits how often a PEX response may be sent to
+	// any one peer, to guard against gossip storms.  If zero, a default
+	// of ten seconds is used.
+	PEXResponseWindow time.Duration
+
+	// RateLimit, if not nil, enables per-source rate limiting of inbound
+	// gossip messages, so a single misbehaving or compromised peer can't
+	// flood OnMessage/OnBroadcast (or a Channel's) handlers.
+	RateLimit *RateLimitConfig
+
+	// EnableUPnP, if true and Address is a private-range address,
+	// attempts to discover a gateway (via UPnP/SSDP, falling back to
+	// NAT-PMP) and map Port to an externally-reachable port.  The
+	// mapping, if obtained, is renewed periodically and released on
+	// Close; it's surfaced via Peer's ExternalAddr method.
+	EnableUPnP bool
+
 	// OnMessage sets the OnMessage field in the generated Peer
 	OnMessage func(p *Peer, src PeerName, message []byte) error
 
@@ -108,8 +182,24 @@ func New(config Config, l Logger) (*Peer, []error, error) {
 		config.ConnLimit = 0
 	}
 
+	/* Load (or start) the address book */
+	addrBook, err := loadAddrBook(config.AddrBookPath)
+	if nil != err {
+		return nil, nil, fmt.Errorf("loading address book: %v", err)
+	}
+
 	/* Peer to return */
-	peer := &Peer{}
+	peer := &Peer{
+		config:          config,
+		addrBook:        addrBook,
+		persistent:      make(map[string]*persistentPeer),
+		establishedAddr: make(map[string]bool),
+		channels:        make(map[string]*Channel),
+		stopCh:          make(chan struct{}),
+	}
+	if nil != config.RateLimit {
+		peer.rateLimiter = newRateLimiter(*config.RateLimit, peer.stopCh)
+	}
 	router := mesh.NewRouter(
 		mesh.Config{
 			Host:               config.Address,
@@ -129,30 +219,86 @@ func New(config Config, l Logger) (*Peer, []error, error) {
 	peer.OnMessage = config.OnMessage
 	peer.OnBroadcast = config.OnBroadcast
 
-	/* Sending and receiving structs.  In theory we could have a bunch of
-	channels, or maybe an interface to make more or something. */
+	/* Sending and receiving structs for the default channel, backing
+	Peer's top-level Send and Broadcast methods. */
 	rx := &receiver{peer}
-	tx := router.NewGossip("defaultchannel", rx)
+	tx := router.NewGossip(defaultChannelName, rx)
 	peer.RX = rx
 	peer.TX = tx
+	peer.channels[defaultChannelName] = &Channel{
+		Name:   defaultChannelName,
+		TX:     tx,
+		RX:     rx,
+		p:      peer,
+		active: true,
+	}
 
 	/* Start the listener if we're meant to */
 	if "" != config.Address {
 		peer.Router.Start()
 	}
 
-	/* Connect to the initial peers */
+	/* Connect to the initial peers, and any we remember from last time */
 	errs := peer.Connect(config.InitialPeers)
+	for _, addr := range addrBook.Addrs() {
+		peer.Connect([]*net.TCPAddr{addr})
+	}
+
+	/* Every initial peer is persistent, and gets automatically
+	reconnected on disconnect. */
+	for _, addr := range config.InitialPeers {
+		if err := peer.AddPersistentPeer(addr); nil != err {
+			errs = append(errs, err)
+		}
+	}
+
+	/* Keep the AddrBook's PeerName/NickName/LastSeen in sync with peers
+	mesh actually discovers and loses, rather than the zero-value
+	placeholders recorded above and in pex.merge. */
+	go peer.addrBookDiscoveryLoop()
+
+	/* Wire up the peer-exchange channel, if wanted */
+	if 0 < config.PEXInterval {
+		if err := peer.startPEX(config.PEXInterval); nil != err {
+			return nil, nil, fmt.Errorf(
+				"starting peer exchange: %v",
+				err,
+			)
+		}
+	}
+
+	/* Ask the gateway to forward us a port, if wanted */
+	peer.startUPnP()
 
 	return peer, errs, nil
 }
 
-// Broadcast sends a message to every peer in the mesh network.
+// Close shuts the peer down, stopping ezmesh's own background goroutines
+// (persistent-peer reconnection, AddrBook reconciliation, PEX, rate-limiter
+// garbage collection and port-mapping renewal) and releasing any port
+// mapping obtained via Config.EnableUPnP.  The underlying mesh.Router is not
+// stopped.
+func (p *Peer) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.stopCh)
+		p.natMu.Lock()
+		if nil != p.natRelease {
+			p.natRelease()
+		}
+		p.natMu.Unlock()
+	})
+	return nil
+}
+
+// Broadcast sends a message to every peer in the mesh network, on the
+// default channel.  It is a wrapper around the default Channel's Broadcast
+// method.
 func (p *Peer) Broadcast(message []byte) {
 	p.TX.GossipBroadcast(gd(message))
 }
 
-// Send sends the message to the specified peer.
+// Send sends the message to the specified peer, on the default channel.  It
+// is a wrapper around the default Channel's Send method.
 func (p *Peer) Send(dst PeerName, message []byte) error {
 	return p.TX.GossipUnicast(mesh.PeerName(dst), message)
 }
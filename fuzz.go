@@ -0,0 +1,192 @@
+package ezmesh
+
+/*
+ * fuzz.go
+ * Connection fuzzing for chaos/partition-tolerance testing
+ * By J. Stuart McMurray
+ * Created 20170429
+ * Last Modified 20170512
+ */
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// FuzzMode selects the kind of fault a FuzzedConn injects.
+type FuzzMode string
+
+// The following are the valid values of FuzzMode.
+const (
+	// FuzzModeDrop causes reads and writes to occasionally be dropped
+	// (as though the network silently ate them) or the connection to be
+	// dropped outright.
+	FuzzModeDrop FuzzMode = "drop"
+
+	// FuzzModeDelay causes every read and write to be delayed by a
+	// random amount, simulating a slow link.
+	FuzzModeDelay FuzzMode = "delay"
+)
+
+// FuzzConfig configures a FuzzedConn.  It's meant to let tests and
+// chaos-engineering runs simulate a lossy link without an external netem
+// setup.
+type FuzzConfig struct {
+	// Mode selects the kind of fault to inject.  If empty, FuzzModeDrop
+	// is used.
+	Mode FuzzMode
+
+	// MaxDelay caps the duration of any simulated delay.
+	MaxDelay time.Duration
+
+	// ProbDropConn is the probability, on each Read or Write, that the
+	// connection is dropped (by returning io.EOF).  Only used in
+	// FuzzModeDrop.
+	ProbDropConn float64
+
+	// ProbDropRW is the probability, on each Read or Write, that the
+	// call silently does nothing (returns 0, nil).  Only used in
+	// FuzzModeDrop.
+	ProbDropRW float64
+
+	// ProbSleep is the probability, on each Read or Write, that the call
+	// is delayed by a random duration up to MaxDelay before proceeding.
+	// Only used in FuzzModeDrop; in FuzzModeDelay every call is delayed.
+	ProbSleep float64
+
+	// Active controls whether fuzzing is in effect.  It may also be
+	// toggled at runtime with the FuzzedConn's SetActive method.
+	Active bool
+}
+
+// FuzzedConn wraps a net.Conn, injecting faults on Read and Write as
+// configured by a FuzzConfig.  It's modeled on tendermint's
+// FuzzedConnection.
+//
+// FuzzedConn is not wired into ezmesh's own mesh transport: the vendored
+// github.com/weaveworks/mesh Router owns its TCP listener and dialer
+// internally and doesn't expose a hook to wrap the resulting net.Conn.
+// It's exported so callers with their own net.Listener or Dialer (or a
+// future version of mesh with such a hook) can use it directly, by wrapping
+// each accepted/dialed net.Conn with NewFuzzedConn before handing it off.
+type FuzzedConn struct {
+	net.Conn
+
+	mu     sync.Mutex
+	active bool
+	cfg    FuzzConfig
+
+	// start fires once fuzzing may begin; until then, Read and Write are
+	// passed straight through.  This lets fuzzing be delayed until after
+	// handshake completion.
+	start <-chan time.Time
+	armed bool
+}
+
+// NewFuzzedConn wraps conn per cfg.  If start is non-nil, fuzzing doesn't
+// begin until a value is received from (or start is closed).  A nil start
+// behaves as though it fired immediately.
+func NewFuzzedConn(conn net.Conn, cfg FuzzConfig, start <-chan time.Time) *FuzzedConn {
+	return &FuzzedConn{
+		Conn:   conn,
+		active: cfg.Active,
+		cfg:    cfg,
+		start:  start,
+		armed:  nil == start,
+	}
+}
+
+// SetActive turns fuzzing on or off.
+func (c *FuzzedConn) SetActive(active bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active = active
+}
+
+// Read implements net.Conn, injecting faults as configured.
+func (c *FuzzedConn) Read(b []byte) (int, error) {
+	if drop, sleep, ok := c.roll(); !ok {
+		return c.Conn.Read(b)
+	} else if drop {
+		return 0, io.EOF
+	} else if sleep {
+		return 0, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// Write implements net.Conn, injecting faults as configured.
+func (c *FuzzedConn) Write(b []byte) (int, error) {
+	if drop, sleep, ok := c.roll(); !ok {
+		return c.Conn.Write(b)
+	} else if drop {
+		return 0, io.EOF
+	} else if sleep {
+		return 0, nil
+	}
+	return c.Conn.Write(b)
+}
+
+// roll decides what, if anything, should happen to the current Read or
+// Write call.  ok is false if fuzzing isn't (yet, or any longer) in effect,
+// in which case the call should proceed normally.  Otherwise at most one of
+// drop (connection dropped via io.EOF) or sleep (call silently dropped,
+// returning 0, nil) is true; in FuzzModeDelay both are always false.  Any
+// delay rolled has already been slept by the time roll returns; if both are
+// false the call should proceed normally.
+func (c *FuzzedConn) roll() (drop, sleep, ok bool) {
+	c.mu.Lock()
+	active := c.active
+	cfg := c.cfg
+	armed := c.armed
+	c.mu.Unlock()
+
+	if !armed {
+		select {
+		case <-c.start:
+			c.mu.Lock()
+			c.armed = true
+			c.mu.Unlock()
+		default:
+			return false, false, false
+		}
+	}
+
+	if !active {
+		return false, false, false
+	}
+
+	mode := cfg.Mode
+	if "" == mode {
+		mode = FuzzModeDrop
+	}
+
+	if FuzzModeDelay == mode {
+		sleepUpTo(cfg.MaxDelay)
+		return false, false, true
+	}
+
+	if 0 < cfg.ProbDropConn && rand.Float64() < cfg.ProbDropConn {
+		return true, false, true
+	}
+	if 0 < cfg.ProbDropRW && rand.Float64() < cfg.ProbDropRW {
+		return false, true, true
+	}
+	if 0 < cfg.ProbSleep && rand.Float64() < cfg.ProbSleep {
+		sleepUpTo(cfg.MaxDelay)
+	}
+
+	return false, false, true
+}
+
+// sleepUpTo sleeps a uniformly-distributed random duration in [0, max).  If
+// max is non-positive, it doesn't sleep at all.
+func sleepUpTo(max time.Duration) {
+	if 0 >= max {
+		return
+	}
+	time.Sleep(time.Duration(rand.Int63n(int64(max))))
+}
@@ -0,0 +1,134 @@
+package ezmesh
+
+/*
+ * fuzz_test.go
+ * Tests for connection fuzzing
+ * By J. Stuart McMurray
+ * Created 20170429
+ * Last Modified 20170429
+ */
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// rollIterations is the number of times roll is called per statistical test
+// below, chosen to keep the observed rate within tolerance of the
+// configured probability without making the test slow.
+const rollIterations = 100000
+
+// tolerance is the maximum allowed difference between an observed rate and
+// the configured probability it's meant to approximate.
+const tolerance = 0.02
+
+func newTestFuzzedConn(cfg FuzzConfig) *FuzzedConn {
+	return &FuzzedConn{
+		active: true,
+		cfg:    cfg,
+		armed:  true,
+	}
+}
+
+func TestFuzzedConnRollProbDropConn(t *testing.T) {
+	c := newTestFuzzedConn(FuzzConfig{
+		Mode:         FuzzModeDrop,
+		ProbDropConn: 0.3,
+	})
+	var drops int
+	for i := 0; i < rollIterations; i++ {
+		drop, sleep, ok := c.roll()
+		if !ok {
+			t.Fatalf("roll %d: ok false with fuzzing active", i)
+		}
+		if sleep {
+			t.Fatalf("roll %d: sleep true, want false", i)
+		}
+		if drop {
+			drops++
+		}
+	}
+	rate := float64(drops) / rollIterations
+	if math.Abs(rate-0.3) > tolerance {
+		t.Errorf("drop rate = %v, want ~0.3 (+/- %v)", rate, tolerance)
+	}
+}
+
+func TestFuzzedConnRollProbDropRW(t *testing.T) {
+	c := newTestFuzzedConn(FuzzConfig{
+		Mode:       FuzzModeDrop,
+		ProbDropRW: 0.4,
+	})
+	var dropped int
+	for i := 0; i < rollIterations; i++ {
+		drop, sleep, ok := c.roll()
+		if !ok {
+			t.Fatalf("roll %d: ok false with fuzzing active", i)
+		}
+		if drop {
+			t.Fatalf("roll %d: drop true, want false", i)
+		}
+		if sleep {
+			dropped++
+		}
+	}
+	rate := float64(dropped) / rollIterations
+	if math.Abs(rate-0.4) > tolerance {
+		t.Errorf("drop-RW rate = %v, want ~0.4 (+/- %v)", rate, tolerance)
+	}
+}
+
+func TestFuzzedConnRollInactive(t *testing.T) {
+	c := newTestFuzzedConn(FuzzConfig{
+		Mode:         FuzzModeDrop,
+		ProbDropConn: 1,
+	})
+	c.active = false
+	for i := 0; i < 100; i++ {
+		if _, _, ok := c.roll(); ok {
+			t.Fatalf("roll %d: ok true with fuzzing inactive", i)
+		}
+	}
+}
+
+func TestFuzzedConnRollUnarmed(t *testing.T) {
+	start := make(chan time.Time)
+	c := NewFuzzedConn(nil, FuzzConfig{
+		Mode:         FuzzModeDrop,
+		ProbDropConn: 1,
+		Active:       true,
+	}, start)
+	if _, _, ok := c.roll(); ok {
+		t.Fatal("roll: ok true before start fired")
+	}
+	close(start)
+	if _, _, ok := c.roll(); !ok {
+		t.Fatal("roll: ok false after start fired")
+	}
+}
+
+func TestFuzzedConnRollModeDelay(t *testing.T) {
+	c := newTestFuzzedConn(FuzzConfig{
+		Mode:     FuzzModeDelay,
+		MaxDelay: time.Millisecond,
+	})
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		drop, sleep, ok := c.roll()
+		if !ok {
+			t.Fatalf("roll %d: ok false with fuzzing active", i)
+		}
+		if drop || sleep {
+			t.Fatalf(
+				"roll %d: drop=%v sleep=%v, want false, false",
+				i,
+				drop,
+				sleep,
+			)
+		}
+	}
+	if 0 == time.Since(start) {
+		t.Fatal("roll: no time elapsed in FuzzModeDelay")
+	}
+}
@@ -0,0 +1,57 @@
+// Package nat requests automatic port mappings from home routers, so peers
+// behind consumer NAT don't need to configure port forwarding by hand.  It's
+// modeled on tendermint's upnp package, but also falls back to NAT-PMP if
+// UPnP/SSDP discovery times out.
+package nat
+
+/*
+ * nat.go
+ * UPnP/NAT-PMP automatic port mapping
+ * By J. Stuart McMurray
+ * Created 20170505
+ * Last Modified 20170505
+ */
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// DiscoveryTimeout is how long Map waits for a UPnP IGD to answer an SSDP
+// discovery request before falling back to NAT-PMP.
+var DiscoveryTimeout = 3 * time.Second
+
+// Mapping describes a port mapping obtained by Map.
+type Mapping struct {
+	// ExternalIP is the WAN address of the gateway which made the
+	// mapping.
+	ExternalIP net.IP
+
+	// ExternalPort is the WAN port which was mapped to internalPort.
+	ExternalPort uint16
+}
+
+// Addr returns m as a *net.TCPAddr.
+func (m *Mapping) Addr() *net.TCPAddr {
+	return &net.TCPAddr{IP: m.ExternalIP, Port: int(m.ExternalPort)}
+}
+
+// Map requests a TCP port mapping from internalPort to an externally
+// reachable port, preferring UPnP/SSDP and falling back to NAT-PMP if no IGD
+// answers within DiscoveryTimeout.  The returned release function removes
+// the mapping, and should be called when the mapping is no longer needed
+// (e.g. when the Peer is Closed).
+func Map(internalPort uint16, lease time.Duration) (*Mapping, func() error, error) {
+	if m, release, err := mapUPnP(internalPort, lease); nil == err {
+		return m, release, nil
+	}
+	m, release, err := mapPMP(internalPort, lease)
+	if nil != err {
+		return nil, nil, fmt.Errorf(
+			"no UPnP IGD or NAT-PMP gateway answered: %v",
+			err,
+		)
+	}
+	return m, release, nil
+}
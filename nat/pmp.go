@@ -0,0 +1,184 @@
+package nat
+
+/*
+ * pmp.go
+ * NAT-PMP (RFC 6886) fallback port mapping
+ * By J. Stuart McMurray
+ * Created 20170505
+ * Last Modified 20170505
+ */
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// pmpPort is the well-known NAT-PMP port on which the gateway listens.
+// Requests are sent from an ephemeral local port.
+const pmpPort = 5351
+
+// pmpTimeout bounds a single NAT-PMP request/response round-trip.
+const pmpTimeout = 2 * time.Second
+
+// pmpOpExternalAddr and pmpOpMapTCP are NAT-PMP opcodes.
+const (
+	pmpOpExternalAddr = 0
+	pmpOpMapTCP       = 2
+)
+
+// mapPMP asks a NAT-PMP gateway to map internalPort, falling back to it
+// when no UPnP IGD answers.  Go's standard library has no access to the
+// host's routing table, so the gateway is guessed to be the ".1" address of
+// each local interface's subnet, which is true of the overwhelming majority
+// of consumer NAT setups but is not guaranteed in general.
+func mapPMP(internalPort uint16, lease time.Duration) (*Mapping, func() error, error) {
+	gateways, err := guessGateways()
+	if nil != err {
+		return nil, nil, err
+	}
+
+	var lastErr error
+	for _, gw := range gateways {
+		m, release, err := mapPMPVia(gw, internalPort, lease)
+		if nil != err {
+			lastErr = err
+			continue
+		}
+		return m, release, nil
+	}
+	if nil == lastErr {
+		lastErr = fmt.Errorf("no gateway candidates found")
+	}
+	return nil, nil, fmt.Errorf("NAT-PMP: %v", lastErr)
+}
+
+// mapPMPVia performs the NAT-PMP external-address and port-mapping requests
+// against the gateway at gw.
+func mapPMPVia(
+	gw net.IP,
+	internalPort uint16,
+	lease time.Duration,
+) (*Mapping, func() error, error) {
+	extIP, err := pmpExternalAddr(gw)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	extPort, err := pmpMapTCP(gw, internalPort, internalPort, lease)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	m := &Mapping{ExternalIP: extIP, ExternalPort: extPort}
+	release := func() error {
+		_, err := pmpMapTCP(gw, internalPort, 0, 0)
+		return err
+	}
+
+	return m, release, nil
+}
+
+// pmpExternalAddr sends a NAT-PMP "public address request" to gw.
+func pmpExternalAddr(gw net.IP) (net.IP, error) {
+	resp, err := pmpRequest(gw, []byte{0, pmpOpExternalAddr}, 12)
+	if nil != err {
+		return nil, err
+	}
+	if err := pmpResultCode(resp); nil != err {
+		return nil, err
+	}
+	return net.IPv4(resp[8], resp[9], resp[10], resp[11]), nil
+}
+
+// pmpMapTCP sends a NAT-PMP "map port" request to gw.  A requested lifetime
+// of 0 deletes the mapping.
+func pmpMapTCP(
+	gw net.IP,
+	internalPort, suggestedExternalPort uint16,
+	lease time.Duration,
+) (uint16, error) {
+	req := make([]byte, 12)
+	req[0] = 0
+	req[1] = pmpOpMapTCP
+	binary.BigEndian.PutUint16(req[4:6], internalPort)
+	binary.BigEndian.PutUint16(req[6:8], suggestedExternalPort)
+	binary.BigEndian.PutUint32(req[8:12], uint32(lease.Seconds()))
+
+	resp, err := pmpRequest(gw, req, 16)
+	if nil != err {
+		return 0, err
+	}
+	if err := pmpResultCode(resp); nil != err {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(resp[10:12]), nil
+}
+
+// pmpResultCode checks the result code in a NAT-PMP response, returning an
+// error describing it if it's non-zero.
+func pmpResultCode(resp []byte) error {
+	if code := binary.BigEndian.Uint16(resp[2:4]); 0 != code {
+		return fmt.Errorf("NAT-PMP result code %d", code)
+	}
+	return nil
+}
+
+// pmpRequest sends req to gw's NAT-PMP port and returns its reply, which
+// must be at least wantLen bytes.
+func pmpRequest(gw net.IP, req []byte, wantLen int) ([]byte, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(gw.String(), fmt.Sprint(pmpPort)))
+	if nil != err {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(pmpTimeout))
+	if _, err := conn.Write(req); nil != err {
+		return nil, err
+	}
+
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if nil != err {
+		return nil, err
+	}
+	if n < wantLen {
+		return nil, fmt.Errorf("short NAT-PMP response (%d bytes)", n)
+	}
+	return buf[:n], nil
+}
+
+// guessGateways returns the ".1" address of every non-loopback IPv4 subnet
+// configured on the host, in the absence of a portable way to read the
+// system's actual default gateway.
+func guessGateways() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if nil != err {
+		return nil, err
+	}
+
+	var gws []net.IP
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip4 := ipnet.IP.To4()
+		if nil == ip4 || ip4.IsLoopback() {
+			continue
+		}
+		gw := make(net.IP, net.IPv4len)
+		copy(gw, ip4)
+		gw[3] = 1
+		if gw.Equal(ip4) {
+			continue
+		}
+		gws = append(gws, gw)
+	}
+	if 0 == len(gws) {
+		return nil, fmt.Errorf("no candidate gateways found")
+	}
+	return gws, nil
+}
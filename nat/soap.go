@@ -0,0 +1,138 @@
+package nat
+
+/*
+ * soap.go
+ * SOAP calls to a UPnP WAN connection service
+ * By J. Stuart McMurray
+ * Created 20170505
+ * Last Modified 20170505
+ */
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// soapEnvelope wraps a SOAP action body.
+const soapEnvelope = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body>%s</s:Body>
+</s:Envelope>`
+
+// soapCall issues a SOAP action against dev's control URL.
+func soapCall(dev *igd, action, body string) ([]byte, error) {
+	envelope := fmt.Sprintf(soapEnvelope, body)
+	req, err := http.NewRequest(
+		"POST", dev.controlURL, bytes.NewReader([]byte(envelope)),
+	)
+	if nil != err {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set(
+		"SOAPAction",
+		fmt.Sprintf(`"%s#%s"`, dev.serviceType, action),
+	)
+
+	resp, err := http.DefaultClient.Do(req)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	buf := new(bytes.Buffer)
+	if _, err := buf.ReadFrom(resp.Body); nil != err {
+		return nil, err
+	}
+	if 300 <= resp.StatusCode {
+		return nil, fmt.Errorf(
+			"SOAP %v failed: %v: %s",
+			action,
+			resp.Status,
+			buf.Bytes(),
+		)
+	}
+	return buf.Bytes(), nil
+}
+
+// soapAddPortMapping asks dev to map extPort to internalIP:internalPort for
+// TCP, for the given lease duration (0 means an indefinite lease, subject to
+// the IGD's own limits).
+func soapAddPortMapping(
+	dev *igd,
+	internalIP net.IP,
+	internalPort, extPort uint16,
+	lease time.Duration,
+) error {
+	body := fmt.Sprintf(
+		`<u:AddPortMapping xmlns:u="%s">`+
+			`<NewRemoteHost></NewRemoteHost>`+
+			`<NewExternalPort>%d</NewExternalPort>`+
+			`<NewProtocol>TCP</NewProtocol>`+
+			`<NewInternalPort>%d</NewInternalPort>`+
+			`<NewInternalClient>%s</NewInternalClient>`+
+			`<NewEnabled>1</NewEnabled>`+
+			`<NewPortMappingDescription>ezmesh</NewPortMappingDescription>`+
+			`<NewLeaseDuration>%d</NewLeaseDuration>`+
+			`</u:AddPortMapping>`,
+		dev.serviceType,
+		extPort,
+		internalPort,
+		internalIP,
+		int(lease.Seconds()),
+	)
+	_, err := soapCall(dev, "AddPortMapping", body)
+	return err
+}
+
+// soapDeletePortMapping removes the TCP mapping for extPort from dev.
+func soapDeletePortMapping(dev *igd, extPort uint16) error {
+	body := fmt.Sprintf(
+		`<u:DeletePortMapping xmlns:u="%s">`+
+			`<NewRemoteHost></NewRemoteHost>`+
+			`<NewExternalPort>%d</NewExternalPort>`+
+			`<NewProtocol>TCP</NewProtocol>`+
+			`</u:DeletePortMapping>`,
+		dev.serviceType,
+		extPort,
+	)
+	_, err := soapCall(dev, "DeletePortMapping", body)
+	return err
+}
+
+// externalIPResponse is the body of a GetExternalIPAddress response.
+type externalIPResponse struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Resp struct {
+			ExternalIPAddress string `xml:"NewExternalIPAddress"`
+		} `xml:"GetExternalIPAddressResponse"`
+	} `xml:"Body"`
+}
+
+// soapExternalIP asks dev for the gateway's current external IP address.
+func soapExternalIP(dev *igd) (net.IP, error) {
+	body := fmt.Sprintf(
+		`<u:GetExternalIPAddress xmlns:u="%s"></u:GetExternalIPAddress>`,
+		dev.serviceType,
+	)
+	b, err := soapCall(dev, "GetExternalIPAddress", body)
+	if nil != err {
+		return nil, err
+	}
+	var r externalIPResponse
+	if err := xml.Unmarshal(b, &r); nil != err {
+		return nil, err
+	}
+	ip := net.ParseIP(r.Body.Resp.ExternalIPAddress)
+	if nil == ip {
+		return nil, fmt.Errorf(
+			"bad external IP %q", r.Body.Resp.ExternalIPAddress,
+		)
+	}
+	return ip, nil
+}
@@ -0,0 +1,216 @@
+package nat
+
+/*
+ * ssdp.go
+ * UPnP IGD discovery and port mapping via SSDP/SOAP
+ * By J. Stuart McMurray
+ * Created 20170505
+ * Last Modified 20170505
+ */
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ssdpMulticastAddr is the well-known SSDP multicast address and port.
+const ssdpMulticastAddr = "239.255.255.250:1900"
+
+// igd describes a discovered Internet Gateway Device's control point.
+type igd struct {
+	controlURL  string
+	serviceType string
+}
+
+// mapUPnP discovers a UPnP IGD via SSDP and asks it to map internalPort.
+func mapUPnP(internalPort uint16, lease time.Duration) (*Mapping, func() error, error) {
+	dev, err := discoverIGD()
+	if nil != err {
+		return nil, nil, err
+	}
+
+	localIP, err := localAddrFor(dev.controlURL)
+	if nil != err {
+		return nil, nil, err
+	}
+
+	extPort := internalPort
+	if err := soapAddPortMapping(
+		dev, localIP, internalPort, extPort, lease,
+	); nil != err {
+		return nil, nil, err
+	}
+
+	extIP, err := soapExternalIP(dev)
+	if nil != err {
+		soapDeletePortMapping(dev, extPort)
+		return nil, nil, err
+	}
+
+	m := &Mapping{ExternalIP: extIP, ExternalPort: extPort}
+	release := func() error {
+		return soapDeletePortMapping(dev, extPort)
+	}
+
+	return m, release, nil
+}
+
+// discoverIGD sends an SSDP M-SEARCH for WANIPConnection devices and returns
+// the WAN connection service (WANIPConnection or WANPPPConnection) found in
+// the first responder's device description.  No separate M-SEARCH is sent
+// for WANPPPConnection devices.
+func discoverIGD() (*igd, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if nil != err {
+		return nil, err
+	}
+	defer conn.Close()
+
+	raddr, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddr)
+	if nil != err {
+		return nil, err
+	}
+
+	req := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpMulticastAddr + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:service:WANIPConnection:1\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), raddr); nil != err {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(DiscoveryTimeout))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if nil != err {
+		return nil, fmt.Errorf("no SSDP response: %v", err)
+	}
+
+	loc, err := ssdpLocation(buf[:n])
+	if nil != err {
+		return nil, err
+	}
+
+	return fetchIGDDescription(loc)
+}
+
+// ssdpLocation extracts the LOCATION header from an SSDP response.
+func ssdpLocation(resp []byte) (string, error) {
+	sc := bufio.NewScanner(strings.NewReader(string(resp)))
+	for sc.Scan() {
+		line := sc.Text()
+		if 9 <= len(line) && strings.EqualFold(line[:9], "location:") {
+			return strings.TrimSpace(line[9:]), nil
+		}
+	}
+	return "", fmt.Errorf("no LOCATION header in SSDP response")
+}
+
+/* Minimal subset of a UPnP device description document, enough to find a
+WANIPConnection (or WANPPPConnection) service's control URL. */
+type deviceDesc struct {
+	Device device `xml:"device"`
+}
+
+// device is a single <device> element: either the root InternetGatewayDevice
+// or one of its descendants (e.g. WANDevice, WANConnectionDevice).  Its
+// DeviceList holds device elements directly, not another layer of wrapping,
+// so recursing into it finds services at any depth in the standard IGD tree
+// (InternetGatewayDevice -> WANDevice -> WANConnectionDevice -> service).
+type device struct {
+	DeviceList struct {
+		Device []device `xml:"device"`
+	} `xml:"deviceList"`
+	ServiceList struct {
+		Service []struct {
+			ServiceType string `xml:"serviceType"`
+			ControlURL  string `xml:"controlURL"`
+		} `xml:"service"`
+	} `xml:"serviceList"`
+}
+
+// fetchIGDDescription retrieves the device description at loc and returns
+// the control URL of its WAN connection service.
+func fetchIGDDescription(loc string) (*igd, error) {
+	resp, err := http.Get(loc)
+	if nil != err {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var desc deviceDesc
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); nil != err {
+		return nil, err
+	}
+
+	base, err := controlURLBase(loc)
+	if nil != err {
+		return nil, err
+	}
+
+	dev, ok := findWANConnectionService(&desc.Device)
+	if !ok {
+		return nil, fmt.Errorf(
+			"no WANIPConnection/WANPPPConnection service found at %v",
+			loc,
+		)
+	}
+	if !strings.HasPrefix(dev.controlURL, "http") {
+		dev.controlURL = base + dev.controlURL
+	}
+
+	return dev, nil
+}
+
+// findWANConnectionService searches dev (and its sub-devices, recursively)
+// for a WAN connection service.
+func findWANConnectionService(dev *device) (*igd, bool) {
+	for _, svc := range dev.ServiceList.Service {
+		if strings.Contains(svc.ServiceType, "WANIPConnection") ||
+			strings.Contains(svc.ServiceType, "WANPPPConnection") {
+			return &igd{
+				controlURL:  svc.ControlURL,
+				serviceType: svc.ServiceType,
+			}, true
+		}
+	}
+	for i := range dev.DeviceList.Device {
+		if found, ok := findWANConnectionService(&dev.DeviceList.Device[i]); ok {
+			return found, true
+		}
+	}
+	return nil, false
+}
+
+// controlURLBase returns the scheme://host[:port] portion of loc, used to
+// resolve a relative control URL.
+func controlURLBase(loc string) (string, error) {
+	u, err := url.Parse(loc)
+	if nil != err {
+		return "", err
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// localAddrFor returns the local IP address which would be used to reach
+// the host in rawurl.
+func localAddrFor(rawurl string) (net.IP, error) {
+	u, err := url.Parse(rawurl)
+	if nil != err {
+		return nil, err
+	}
+	host := u.Hostname()
+	conn, err := net.Dial("udp4", net.JoinHostPort(host, "80"))
+	if nil != err {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -0,0 +1,131 @@
+package nat
+
+/*
+ * ssdp_test.go
+ * Tests for UPnP device description parsing
+ * By J. Stuart McMurray
+ * Created 20170505
+ * Last Modified 20170505
+ */
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestFindWANConnectionService(t *testing.T) {
+	cases := []struct {
+		name        string
+		doc         string
+		wantFound   bool
+		wantControl string
+	}{
+		{
+			name: "service on root device",
+			doc: `<root>
+				<device>
+					<serviceList>
+						<service>
+							<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+							<controlURL>/ctl/root</controlURL>
+						</service>
+					</serviceList>
+				</device>
+			</root>`,
+			wantFound:   true,
+			wantControl: "/ctl/root",
+		},
+		{
+			name: "service one level down (WANDevice)",
+			doc: `<root>
+				<device>
+					<deviceList>
+						<device>
+							<serviceList>
+								<service>
+									<serviceType>urn:schemas-upnp-org:service:WANPPPConnection:1</serviceType>
+									<controlURL>/ctl/wandevice</controlURL>
+								</service>
+							</serviceList>
+						</device>
+					</deviceList>
+				</device>
+			</root>`,
+			wantFound:   true,
+			wantControl: "/ctl/wandevice",
+		},
+		{
+			/* The standard IGD layout: InternetGatewayDevice ->
+			WANDevice -> WANConnectionDevice -> WANIPConnection. */
+			name: "service two levels down (WANConnectionDevice)",
+			doc: `<root>
+				<device>
+					<deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+					<deviceList>
+						<device>
+							<deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+							<deviceList>
+								<device>
+									<deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+									<serviceList>
+										<service>
+											<serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+											<controlURL>/ctl/wanconnectiondevice</controlURL>
+										</service>
+									</serviceList>
+								</device>
+							</deviceList>
+						</device>
+					</deviceList>
+				</device>
+			</root>`,
+			wantFound:   true,
+			wantControl: "/ctl/wanconnectiondevice",
+		},
+		{
+			name: "no matching service anywhere",
+			doc: `<root>
+				<device>
+					<deviceList>
+						<device>
+							<serviceList>
+								<service>
+									<serviceType>urn:schemas-upnp-org:service:Layer3Forwarding:1</serviceType>
+									<controlURL>/ctl/l3f</controlURL>
+								</service>
+							</serviceList>
+						</device>
+					</deviceList>
+				</device>
+			</root>`,
+			wantFound: false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var desc deviceDesc
+			if err := xml.NewDecoder(
+				strings.NewReader(c.doc),
+			).Decode(&desc); nil != err {
+				t.Fatalf("decoding: %v", err)
+			}
+
+			dev, ok := findWANConnectionService(&desc.Device)
+			if ok != c.wantFound {
+				t.Fatalf("found = %v, want %v", ok, c.wantFound)
+			}
+			if !c.wantFound {
+				return
+			}
+			if dev.controlURL != c.wantControl {
+				t.Errorf(
+					"controlURL = %q, want %q",
+					dev.controlURL,
+					c.wantControl,
+				)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package ezmesh
+
+/*
+ * persistent.go
+ * Automatic reconnection to persistent peers
+ * By J. Stuart McMurray
+ * Created 20170420
+ * Last Modified 20170512
+ */
+
+import (
+	"net"
+	"time"
+)
+
+// defaultMaxReconnectInterval is used when Config.MaxReconnectInterval isn't
+// set.
+const defaultMaxReconnectInterval = time.Minute
+
+// persistentPeer tracks the reconnection state for a single persistent
+// peer.
+type persistentPeer struct {
+	addr *net.TCPAddr
+	stop chan struct{}
+}
+
+// AddPersistentPeer marks addr as persistent and makes an initial connection
+// attempt to it.  A background goroutine will then attempt to keep a
+// connection to addr alive for the life of p, redialing with an exponential
+// backoff (starting at one second and capped at Config.MaxReconnectInterval)
+// whenever the connection is lost.  If Config.MaxReconnectAttempts is
+// positive, reconnection is abandoned after that many consecutive failed
+// attempts; see reconnectLoop for what "abandoned" actually entails.
+func (p *Peer) AddPersistentPeer(addr *net.TCPAddr) error {
+	p.persistentMu.Lock()
+	defer p.persistentMu.Unlock()
+
+	key := addr.String()
+	if _, ok := p.persistent[key]; ok {
+		return nil
+	}
+	pp := &persistentPeer{
+		addr: addr,
+		stop: make(chan struct{}),
+	}
+	p.persistent[key] = pp
+
+	if nil != p.addrBook {
+		/* Real PeerName/NickName are filled in by
+		reconcileAddrBook once the connection's handshake
+		completes. */
+		p.addrBook.Update(addr, PeerName(0), "")
+	}
+
+	/* Dial addr ourselves.  New already does this for
+	Config.InitialPeers before calling AddPersistentPeer (redialing
+	an already-dialed address is a harmless no-op for
+	ConnectionMaker), but a peer added directly via this method
+	would otherwise never be dialed at all: reconnectLoop only
+	redials on loss, and connectedTo reports an address mesh has
+	never been told to connect to as already connected. */
+	p.Connect([]*net.TCPAddr{addr})
+
+	go p.reconnectLoop(pp)
+
+	return nil
+}
+
+// RemovePersistentPeer un-marks addr as persistent, stopping any background
+// reconnection attempts being made to it, including mesh's own (addr is
+// forgotten as a direct target, so the underlying mesh.Router stops
+// redialing it too).  Any existing connection to addr is left alone.
+func (p *Peer) RemovePersistentPeer(addr *net.TCPAddr) error {
+	p.persistentMu.Lock()
+	defer p.persistentMu.Unlock()
+
+	key := addr.String()
+	pp, ok := p.persistent[key]
+	if !ok {
+		return nil
+	}
+	close(pp.stop)
+	delete(p.persistent, key)
+
+	p.forgetTarget(addr)
+
+	if nil != p.addrBook {
+		p.addrBook.Remove(addr)
+	}
+
+	return nil
+}
+
+// KnownAddrs returns the addresses of every peer currently in p's AddrBook,
+// including persistent peers.  Addresses the AddrBook has forgotten (lost
+// non-persistent peers, removed persistent peers) are not included.  It may be used to seed Config.InitialPeers on
+// a subsequent run.
+func (p *Peer) KnownAddrs() []*net.TCPAddr {
+	if nil == p.addrBook {
+		return nil
+	}
+	return p.addrBook.Addrs()
+}
+
+// reconnectLoop keeps pp connected for as long as it's not removed from
+// p.persistent or p is closed.
+func (p *Peer) reconnectLoop(pp *persistentPeer) {
+	maxInterval := p.config.MaxReconnectInterval
+	if 0 == maxInterval {
+		maxInterval = defaultMaxReconnectInterval
+	}
+
+	interval := time.Second
+	attempts := 0
+	for {
+		/* Give up after too many failed attempts.  mesh's own
+		ConnectionMaker retries every address in its direct-peers
+		set indefinitely, on its own schedule, regardless of our
+		backoff; without forgetting the target here, "giving up"
+		would only stop ezmesh's bookkeeping while mesh kept
+		redialing addr forever underneath it. */
+		if 0 < p.config.MaxReconnectAttempts &&
+			attempts >= p.config.MaxReconnectAttempts {
+			p.forgetTarget(pp.addr)
+			return
+		}
+
+		select {
+		case <-pp.stop:
+			return
+		case <-p.stopCh:
+			return
+		default:
+		}
+
+		if p.connectedTo(pp.addr) {
+			/* Already connected; reset backoff and check back
+			in a bit. */
+			interval = time.Second
+			attempts = 0
+		} else {
+			attempts++
+			p.Connect([]*net.TCPAddr{pp.addr})
+		}
+
+		select {
+		case <-pp.stop:
+			return
+		case <-p.stopCh:
+			return
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > maxInterval {
+			interval = maxInterval
+		}
+	}
+}
+
+// forgetTarget tells mesh's ConnectionMaker to stop managing addr as a
+// direct target, so it stops redialing addr on its own once ezmesh has
+// decided to (whether via RemovePersistentPeer or reconnectLoop giving up
+// after Config.MaxReconnectAttempts).
+func (p *Peer) forgetTarget(addr *net.TCPAddr) {
+	if nil == p.Router || nil == p.Router.ConnectionMaker {
+		return
+	}
+	p.Router.ConnectionMaker.ForgetConnections([]string{addr.String()})
+}
+
+// connectedTo reports whether p currently has a live connection to addr.
+func (p *Peer) connectedTo(addr *net.TCPAddr) bool {
+	if nil == p.Router || nil == p.Router.ConnectionMaker {
+		return false
+	}
+	target := addr.String()
+	for _, t := range p.Router.ConnectionMaker.Targets(true) {
+		/* Targets(true) returns the direct peers which are still
+		being (re)connected to; if ours isn't among them, we're
+		connected. */
+		if t == target {
+			return false
+		}
+	}
+	return true
+}
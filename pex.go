@@ -0,0 +1,256 @@
+package ezmesh
+
+/*
+ * pex.go
+ * Peer-exchange gossip channel
+ * By J. Stuart McMurray
+ * Created 20170423
+ * Last Modified 20170512
+ */
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// pexChannel is the name of the gossip channel used to exchange peer
+// addresses.
+const pexChannel = "ezmesh.pex"
+
+// defaultPEXResponseWindow is used when Config.PEXResponseWindow isn't set.
+const defaultPEXResponseWindow = 10 * time.Second
+
+// pexPeerInfo is a single peer's address and name, as exchanged over the PEX
+// channel.
+type pexPeerInfo struct {
+	Addr     string
+	PeerName PeerName
+}
+
+// pexMessage is the wire format used on the PEX channel, for both broadcast
+// gossip and unicast request/response.
+type pexMessage struct {
+	// Request is true if this message is a request for peers, rather
+	// than a list of peers.
+	Request bool
+	Peers   []pexPeerInfo `json:",omitempty"`
+}
+
+// pex holds the state needed to run the peer-exchange subsystem.  It's built
+// on top of a Channel, same as any other ezmesh gossip subsystem would be.
+type pex struct {
+	p       *Peer
+	channel *Channel
+
+	lastResponseMu sync.Mutex
+	lastResponse   map[PeerName]time.Time
+}
+
+// startPEX subscribes p to the PEX channel and starts a goroutine which
+// periodically broadcasts p's known addresses every interval.
+func (p *Peer) startPEX(interval time.Duration) error {
+	px := &pex{
+		p:            p,
+		lastResponse: make(map[PeerName]time.Time),
+	}
+	c, err := p.Subscribe(pexChannel, ChannelHandlers{
+		OnMessage:   px.onMessage,
+		OnBroadcast: px.onBroadcast,
+	})
+	if nil != err {
+		return err
+	}
+	px.channel = c
+	p.pex = px
+
+	go p.pexLoop(interval)
+
+	return nil
+}
+
+// pexLoop periodically broadcasts p's known addresses on the PEX channel.
+func (p *Peer) pexLoop(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-t.C:
+			p.pex.broadcastPeers()
+		}
+	}
+}
+
+// localAddr returns p's own reachable address, suitable for
+// advertising to other peers over the PEX channel: the UPnP/NAT-PMP-mapped
+// external address if Config.EnableUPnP obtained one, otherwise
+// Config.Address:Port if a listener was started.
+func (p *Peer) localAddr() (*net.TCPAddr, bool) {
+	if a, ok := p.ExternalAddr(); ok {
+		return a, true
+	}
+	if "" == p.config.Address {
+		return nil, false
+	}
+	ip := net.ParseIP(p.config.Address)
+	if nil == ip {
+		return nil, false
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p.config.Port)}, true
+}
+
+// RequestPeers sends dst a unicast request for its list of known peers.  Any
+// peers dst responds with are merged into p's AddrBook, and, subject to
+// Config.AutoConnect and Config.ConnLimit, dialed.  If PEX isn't enabled
+// (Config.PEXInterval isn't positive), it sends nothing and returns nil.
+func (p *Peer) RequestPeers(dst PeerName) error {
+	if nil == p.pex {
+		return nil
+	}
+	b, err := json.Marshal(pexMessage{Request: true})
+	if nil != err {
+		return err
+	}
+	return p.pex.channel.Send(dst, b)
+}
+
+// broadcastPeers gossips a compact list of px's peer's known addresses.
+func (px *pex) broadcastPeers() {
+	b, err := json.Marshal(pexMessage{Peers: px.knownPeers()})
+	if nil != err {
+		return
+	}
+	px.channel.Broadcast(b)
+}
+
+// knownPeers returns the addresses and names of every peer px's Peer knows
+// about: px's own reachable address (so a fresh seed with an empty
+// AddrBook can still bootstrap others) plus everything in the AddrBook.
+func (px *pex) knownPeers() []pexPeerInfo {
+	var infos []pexPeerInfo
+
+	if self, ok := px.p.localAddr(); ok {
+		infos = append(infos, pexPeerInfo{
+			Addr:     self.String(),
+			PeerName: *px.p.config.Name,
+		})
+	}
+
+	if nil != px.p.addrBook {
+		for _, e := range px.p.addrBook.Entries() {
+			infos = append(infos, pexPeerInfo{
+				Addr:     e.Addr,
+				PeerName: e.PeerName,
+			})
+		}
+	}
+
+	return infos
+}
+
+// onMessage is the PEX channel's OnMessage handler.  It handles both peer
+// requests and responses.
+func (px *pex) onMessage(c *Channel, src PeerName, msg []byte) error {
+	var m pexMessage
+	if err := json.Unmarshal(msg, &m); nil != err {
+		return err
+	}
+	if m.Request {
+		return px.respond(src)
+	}
+	px.merge(m.Peers)
+	return nil
+}
+
+// onBroadcast is the PEX channel's OnBroadcast handler.
+func (px *pex) onBroadcast(c *Channel, src PeerName, msg []byte) error {
+	var m pexMessage
+	if err := json.Unmarshal(msg, &m); nil != err {
+		return err
+	}
+	px.merge(m.Peers)
+	return nil
+}
+
+// respond sends px's known peers back to src, unless src has been sent a
+// response too recently.
+func (px *pex) respond(src PeerName) error {
+	if !px.allow(src) {
+		return nil
+	}
+	b, err := json.Marshal(pexMessage{Peers: px.knownPeers()})
+	if nil != err {
+		return err
+	}
+	return px.channel.Send(src, b)
+}
+
+// allow reports whether src may be sent another PEX response, and if so,
+// records that one was just sent.
+func (px *pex) allow(src PeerName) bool {
+	window := px.p.config.PEXResponseWindow
+	if 0 == window {
+		window = defaultPEXResponseWindow
+	}
+
+	px.lastResponseMu.Lock()
+	defer px.lastResponseMu.Unlock()
+
+	if t, ok := px.lastResponse[src]; ok && time.Since(t) < window {
+		return false
+	}
+	px.lastResponse[src] = time.Now()
+	return true
+}
+
+// merge adds infos to px's Peer's AddrBook, and, if appropriate, dials a
+// random subset of the addresses amongst infos which weren't already known.
+func (px *pex) merge(infos []pexPeerInfo) {
+	if nil == px.p.addrBook {
+		return
+	}
+	known := make(map[string]bool)
+	for _, e := range px.p.addrBook.Entries() {
+		known[e.Addr] = true
+	}
+
+	var fresh []*net.TCPAddr
+	for _, info := range infos {
+		a, err := net.ResolveTCPAddr("tcp", info.Addr)
+		if nil != err {
+			continue
+		}
+		/* Real PeerName/NickName, if info.PeerName turns out to be
+		stale, are filled in by reconcileAddrBook once (or if) we
+		actually connect to a. */
+		px.p.addrBook.Update(a, info.PeerName, "")
+		if !known[a.String()] {
+			fresh = append(fresh, a)
+		}
+	}
+
+	if !px.p.config.AutoConnect || 0 == len(fresh) {
+		return
+	}
+	/* Gate on px's Peer's own direct connections, not every peer known
+	anywhere in the mesh (which is what Peers.Descriptions() would give
+	us): otherwise auto-dial stops far too early on a large, well-known
+	mesh. */
+	if 0 < px.p.config.ConnLimit &&
+		px.p.connectedPeerCount() >= px.p.config.ConnLimit {
+		return
+	}
+
+	rand.Shuffle(len(fresh), func(i, j int) {
+		fresh[i], fresh[j] = fresh[j], fresh[i]
+	})
+	n := len(fresh)
+	if 3 < n {
+		n = 3
+	}
+	px.p.Connect(fresh[:n])
+}
@@ -0,0 +1,200 @@
+package ezmesh
+
+/*
+ * ratelimit.go
+ * Per-source token-bucket rate limiting for inbound gossip
+ * By J. Stuart McMurray
+ * Created 20170502
+ * Last Modified 20170512
+ */
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// rateLimiterGCInterval is how often idle buckets are garbage-collected.
+const rateLimiterGCInterval = time.Minute
+
+// rateLimiterIdleAfter is how long a source's bucket may go untouched before
+// it's garbage-collected.
+const rateLimiterIdleAfter = 10 * time.Minute
+
+// RateLimitConfig configures the per-source inbound gossip rate limiter.
+// Inspired by wireguard-go's ratelimiter.go, it stops a single misbehaving
+// or compromised peer from flooding a Peer's OnMessage/OnBroadcast (or a
+// Channel's) handlers.
+type RateLimitConfig struct {
+	// PacketsPerSecond is the steady-state rate at which a single source
+	// may have messages accepted.
+	PacketsPerSecond float64
+
+	// Burst is the largest number of messages a single source may have
+	// accepted in a row, before being limited to PacketsPerSecond.
+	Burst int
+}
+
+// RateLimiterStat reports the current state of a single source's rate
+// limiter bucket.
+type RateLimiterStat struct {
+	// Tokens is the number of messages the source may currently send
+	// before being rate-limited.
+	Tokens float64
+
+	// Dropped is the number of messages from the source which have been
+	// dropped for exceeding the rate limit.
+	Dropped uint64
+}
+
+// Stats holds overall statistics about a Peer.
+type Stats struct {
+	// RateLimitDrops is the total number of inbound messages dropped by
+	// the rate limiter, across all sources.
+	RateLimitDrops uint64
+}
+
+// bucket is a single source's token bucket.
+type bucket struct {
+	tokens     float64
+	lastRefill time.Time
+	touched    time.Time
+	dropped    uint64
+}
+
+// rateLimiter rate-limits inbound gossip messages on a per-source basis.
+type rateLimiter struct {
+	cfg RateLimitConfig
+
+	mu      sync.RWMutex
+	buckets map[mesh.PeerName]*bucket
+
+	// gcDropped is the total dropped count of every bucket gc has ever
+	// removed, so Stats' RateLimitDrops stays monotonic even though the
+	// per-source counts it's folded from don't survive gc.
+	gcDropped uint64
+}
+
+// newRateLimiter returns a rateLimiter enforcing cfg, and starts its
+// garbage-collection goroutine, which runs until stopCh is closed.
+func newRateLimiter(cfg RateLimitConfig, stopCh <-chan struct{}) *rateLimiter {
+	rl := &rateLimiter{
+		cfg:     cfg,
+		buckets: make(map[mesh.PeerName]*bucket),
+	}
+	go rl.gcLoop(stopCh)
+	return rl
+}
+
+// allow reports whether a message from src should be accepted, consuming a
+// token from its bucket if so.  If not, src's drop counter is incremented.
+func (rl *rateLimiter) allow(src mesh.PeerName) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[src]
+	if !ok {
+		b = &bucket{
+			tokens:     float64(rl.cfg.Burst),
+			lastRefill: now,
+		}
+		rl.buckets[src] = b
+	}
+	b.touched = now
+
+	elapsed := now.Sub(b.lastRefill).Seconds()
+	b.lastRefill = now
+	b.tokens += elapsed * rl.cfg.PacketsPerSecond
+	if max := float64(rl.cfg.Burst); b.tokens > max {
+		b.tokens = max
+	}
+
+	if 1 > b.tokens {
+		b.dropped++
+		return false
+	}
+	b.tokens--
+
+	return true
+}
+
+// gcLoop periodically removes buckets for sources which haven't been seen
+// in a while, until stopCh is closed.
+func (rl *rateLimiter) gcLoop(stopCh <-chan struct{}) {
+	t := time.NewTicker(rateLimiterGCInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-t.C:
+			rl.gc()
+		}
+	}
+}
+
+// gc removes idle buckets, folding their dropped counts into gcDropped first
+// so they're still reflected in Stats' RateLimitDrops.
+func (rl *rateLimiter) gc() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for src, b := range rl.buckets {
+		if rateLimiterIdleAfter <= time.Since(b.touched) {
+			rl.gcDropped += b.dropped
+			delete(rl.buckets, src)
+		}
+	}
+}
+
+// stats returns a snapshot of every known source's bucket state.
+func (rl *rateLimiter) stats() map[mesh.PeerName]RateLimiterStat {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	stats := make(map[mesh.PeerName]RateLimiterStat, len(rl.buckets))
+	for src, b := range rl.buckets {
+		stats[src] = RateLimiterStat{
+			Tokens:  b.tokens,
+			Dropped: b.dropped,
+		}
+	}
+	return stats
+}
+
+// totalDropped returns the combined dropped count of every bucket currently
+// live plus every bucket gc has ever removed.
+func (rl *rateLimiter) totalDropped() uint64 {
+	rl.mu.RLock()
+	defer rl.mu.RUnlock()
+	total := rl.gcDropped
+	for _, b := range rl.buckets {
+		total += b.dropped
+	}
+	return total
+}
+
+// RateLimiterStats returns the current rate-limiter state of every source
+// p has seen a message from recently; sources idle for rateLimiterIdleAfter
+// are garbage-collected and no longer listed.  It returns an empty map if
+// Config.RateLimit wasn't set.
+func (p *Peer) RateLimiterStats() map[PeerName]RateLimiterStat {
+	stats := make(map[PeerName]RateLimiterStat)
+	if nil == p.rateLimiter {
+		return stats
+	}
+	for src, s := range p.rateLimiter.stats() {
+		stats[PeerName(src)] = s
+	}
+	return stats
+}
+
+// Stats returns overall statistics about p.
+func (p *Peer) Stats() Stats {
+	var s Stats
+	if nil == p.rateLimiter {
+		return s
+	}
+	s.RateLimitDrops = p.rateLimiter.totalDropped()
+	return s
+}
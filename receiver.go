@@ -50,6 +50,10 @@ func (r *receiver) handle(
 	n mesh.PeerName,
 	msg []byte,
 ) error {
+	/* Drop the message if n has exhausted its rate limit */
+	if nil != r.p.rateLimiter && !r.p.rateLimiter.allow(n) {
+		return nil
+	}
 	/* Ignore the message if there's no handler installed */
 	if nil == f {
 		return nil
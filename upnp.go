@@ -0,0 +1,84 @@
+package ezmesh
+
+/*
+ * upnp.go
+ * Automatic external port mapping via ezmesh/nat
+ * By J. Stuart McMurray
+ * Created 20170508
+ * Last Modified 20170508
+ */
+
+import (
+	"net"
+	"time"
+
+	"github.com/magisterquis/ezmesh/nat"
+)
+
+// natLeaseDuration is the lease requested for a port mapping obtained via
+// EnableUPnP.  It's renewed at half this interval, for as long as p is
+// running.
+const natLeaseDuration = time.Hour
+
+// startUPnP requests an external port mapping for config.Port, if
+// config.EnableUPnP is set and config.Address is a private-range address.
+// Any error is non-fatal; p simply won't have an ExternalAddr.
+func (p *Peer) startUPnP() {
+	if !p.config.EnableUPnP {
+		return
+	}
+	ip := net.ParseIP(p.config.Address)
+	if nil == ip || !ip.IsPrivate() {
+		return
+	}
+
+	m, release, err := nat.Map(p.config.Port, natLeaseDuration)
+	if nil != err {
+		return
+	}
+
+	p.natMu.Lock()
+	p.natMapping = m
+	p.natRelease = release
+	p.natMu.Unlock()
+
+	go p.natRenewLoop()
+}
+
+// natRenewLoop keeps p's port mapping alive for as long as p is running,
+// re-mapping a bit before each lease would otherwise expire.
+func (p *Peer) natRenewLoop() {
+	ticker := time.NewTicker(natLeaseDuration / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stopCh:
+			return
+		case <-ticker.C:
+		}
+		m, release, err := nat.Map(p.config.Port, natLeaseDuration)
+		if nil != err {
+			continue
+		}
+		/* Re-mapping the same internal port refreshes the existing
+		mapping in place; releasing the old one here would delete the
+		mapping just renewed. */
+		p.natMu.Lock()
+		p.natMapping = m
+		p.natRelease = release
+		p.natMu.Unlock()
+	}
+}
+
+// ExternalAddr returns the external (WAN) address mapped to p's listener by
+// EnableUPnP, if a mapping was successfully obtained.  It's suitable for
+// inclusion in PEX broadcasts or logging, so operators know what address to
+// hand to other peers.
+func (p *Peer) ExternalAddr() (*net.TCPAddr, bool) {
+	p.natMu.Lock()
+	defer p.natMu.Unlock()
+	if nil == p.natMapping {
+		return nil, false
+	}
+	return p.natMapping.Addr(), true
+}